@@ -1,14 +1,77 @@
 package main
 
 import (
+	"container/list"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
+	"math/big"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// adminClientSecret authenticates callers of the privileged /introspect and
+// /revoke endpoints via a shared client-credentials secret (X-Client-Secret),
+// overridable with ADMIN_CLIENT_SECRET so a real deployment doesn't ship the
+// demo default.
+var adminClientSecret = getEnv("ADMIN_CLIENT_SECRET", "dev-admin-secret")
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// authenticateAdmin reports whether the request carries the configured
+// client-credentials secret. /introspect and /revoke act on any token this
+// service has ever signed, so - unlike /token/valid and /token/invalid,
+// which are gated by hashcash proof-of-work instead - they need to restrict
+// who can call them at all, not just rate-limit it.
+func authenticateAdmin(r *http.Request) bool {
+	secret := r.Header.Get("X-Client-Secret")
+	if secret == "" || adminClientSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(adminClientSecret)) == 1
+}
+
+var (
+	tokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokens_issued_total",
+		Help: "Count of tokens issued, by kind (valid or invalid).",
+	}, []string{"kind"})
+	introspections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "introspections_total",
+		Help: "Count of introspection requests, by result (active or inactive).",
+	}, []string{"result"})
+	revocations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "revocations_total",
+		Help: "Count of tokens revoked.",
+	})
+	hashcashChallengesIssued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hashcash_challenges_issued_total",
+		Help: "Count of proof-of-work challenges issued.",
+	})
+	hashcashRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hashcash_rejections_total",
+		Help: "Count of token requests rejected for a missing or invalid hashcash stamp, by reason.",
+	}, []string{"reason"})
 )
 
 // JWT signing keys - valid and invalid
@@ -16,11 +79,34 @@ var (
 	validPrivateKey   *rsa.PrivateKey
 	invalidPrivateKey *rsa.PrivateKey
 	validPublicKey    *rsa.PublicKey
+
+	// keyMu guards validPrivateKey, validPublicKey and the rotation state
+	// below. Requests reading the current/previous signing key
+	// (handleValidToken, handlePublicKey, handleJWKS, verifyOwnToken) take an
+	// RLock; rotateSigningKey takes the write lock while it swaps keys.
+	keyMu          sync.RWMutex
+	currentKID     string
+	previousKID    string
+	previousPubKey *rsa.PublicKey
+)
+
+// keyRotationInterval controls how often the vending service cuts a new
+// signing key. Previous keys stay published in the JWKS for tokenTTL so
+// tokens signed right before a rotation still validate.
+const (
+	keyRotationInterval = time.Hour
+	tokenTTL            = 5 * time.Minute
 )
 
 // TokenRequest represents the request body for token generation
 type TokenRequest struct {
 	ServiceID string `json:"service_id"` // e.g., "service-a"
+
+	// JWK optionally binds the issued token to a client-held key (DPoP,
+	// RFC 9449): when present its SHA-256 thumbprint is embedded as the
+	// token's cnf.jkt claim, and the holder must prove possession of the
+	// matching private key on every request.
+	JWK *ECJWK `json:"jwk,omitempty"`
 }
 
 // TokenResponse represents the response containing the JWT
@@ -29,9 +115,48 @@ type TokenResponse struct {
 	ExpiresIn int64  `json:"expires_in"` // seconds
 }
 
+// ECJWK is the public half of a client's P-256 DPoP key, as sent in a
+// TokenRequest and as embedded in a DPoP proof's own header.
+type ECJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ecJWKThumbprint computes the RFC 7638 JWK thumbprint for an EC public key.
+func ecJWKThumbprint(jwk ECJWK) string {
+	thumbprintInput := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	sum := sha256.Sum256([]byte(thumbprintInput))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Cnf carries the confirmation claim (RFC 7800) binding a JWT to a DPoP key.
+type Cnf struct {
+	JKT string `json:"jkt"`
+}
+
 // JWTClaims represents the JWT claims structure
 type JWTClaims struct {
 	jwt.RegisteredClaims
+	Cnf *Cnf `json:"cnf,omitempty"`
+}
+
+// JWK represents a single JSON Web Key as published in the JWKS document
+// (RFC 7517). Only the fields needed for RSA signature verification are
+// included.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKSet is a JWK Set document as served from /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
 }
 
 func init() {
@@ -42,6 +167,7 @@ func init() {
 		log.Fatalf("Failed to generate valid private key: %v", err)
 	}
 	validPublicKey = &validPrivateKey.PublicKey
+	currentKID = keyID(validPublicKey)
 
 	// Generate a different RSA key pair for invalid tokens
 	invalidPrivateKey, err = rsa.GenerateKey(rand.Reader, 2048)
@@ -52,13 +178,100 @@ func init() {
 	log.Println("JWT signing keys generated successfully")
 }
 
-// generateToken creates a JWT token signed with the specified key
-func generateToken(serviceID string, privateKey *rsa.PrivateKey) (string, error) {
+// keyID derives a stable key identifier for a public key by taking the
+// SHA-256 thumbprint (RFC 7638) of its JWK representation and
+// base64url-encoding the first 16 bytes.
+func keyID(pub *rsa.PublicKey) string {
+	n := base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	thumbprintInput := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, e, n)
+	sum := sha256.Sum256([]byte(thumbprintInput))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// jwkFromPublicKey converts an RSA public key into its JWK representation.
+func jwkFromPublicKey(pub *rsa.PublicKey, kid string) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// rotateSigningKey cuts a fresh RSA keypair for valid tokens, demoting the
+// current key to "previous" so in-flight tokens (issued up to tokenTTL ago)
+// keep validating against the JWKS during the grace period.
+func rotateSigningKey() {
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Printf("key rotation: failed to generate new key: %v", err)
+		return
+	}
+	newKID := keyID(&newKey.PublicKey)
+
+	keyMu.Lock()
+	previousPubKey = validPublicKey
+	previousKID = currentKID
+	validPrivateKey = newKey
+	validPublicKey = &newKey.PublicKey
+	currentKID = newKID
+	keyMu.Unlock()
+
+	log.Printf("key rotation: rotated signing key (new kid=%s, previous kid=%s retained for %s)",
+		newKID, previousKID, tokenTTL)
+
+	// Drop the previous key once every token signed with it has expired.
+	time.AfterFunc(tokenTTL, func() {
+		keyMu.Lock()
+		if previousKID == newKID {
+			// A later rotation already replaced this entry; leave it alone.
+			keyMu.Unlock()
+			return
+		}
+		previousPubKey = nil
+		previousKID = ""
+		keyMu.Unlock()
+		log.Printf("key rotation: dropped expired previous key")
+	})
+}
+
+// startKeyRotation periodically rotates the signing key in the background.
+func startKeyRotation() {
+	ticker := time.NewTicker(keyRotationInterval)
+	go func() {
+		for range ticker.C {
+			rotateSigningKey()
+		}
+	}()
+}
+
+// generateJTI returns a random token identifier (RFC 7519 jti), used to
+// introspect and revoke a specific token without tracking its full value.
+func generateJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate jti: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// generateToken creates a JWT token signed with the specified key. When jwk
+// is non-nil the token is bound to it via a cnf.jkt claim (DPoP, RFC 9449).
+func generateToken(serviceID string, privateKey *rsa.PrivateKey, kid string, jwk *ECJWK) (string, error) {
 	now := time.Now()
-	expiresAt := now.Add(5 * time.Minute)
+	expiresAt := now.Add(tokenTTL)
+
+	jti, err := generateJTI()
+	if err != nil {
+		return "", err
+	}
 
 	claims := JWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			Subject:   serviceID,
 			Issuer:    "jwt-vending-service",
 			Audience:  jwt.ClaimStrings{"service-mesh"},
@@ -67,8 +280,12 @@ func generateToken(serviceID string, privateKey *rsa.PrivateKey) (string, error)
 			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
+	if jwk != nil {
+		claims.Cnf = &Cnf{JKT: ecJWKThumbprint(*jwk)}
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
 	tokenString, err := token.SignedString(privateKey)
 	if err != nil {
 		return "", err
@@ -77,6 +294,197 @@ func generateToken(serviceID string, privateKey *rsa.PrivateKey) (string, error)
 	return tokenString, nil
 }
 
+// hashcashDifficultyBits is the number of leading zero bits a solved
+// hashcash stamp's SHA-256 digest must have. hashcashChallengeTTL bounds how
+// long a caller has to solve a challenge before the vending service stops
+// accepting it, and hashcashNonceCacheSize bounds the single-use nonce LRU
+// so a flood of fresh challenges can't grow it without bound.
+const (
+	hashcashDifficultyBits = 18
+	hashcashChallengeTTL   = 2 * time.Minute
+	hashcashNonceCacheSize = 4096
+)
+
+// hashcashSecret HMACs a challenge's fields so the vending service can
+// authenticate one it issued without keeping any state beyond the
+// single-use nonce cache below.
+var hashcashSecret = mustRandomBytes(32)
+
+func mustRandomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate hashcash secret: %v", err)
+	}
+	return b
+}
+
+// HashcashChallenge is the response to POST /api/new-hashcash: a
+// proof-of-work puzzle tied to one service_id that the caller must solve
+// and echo back via the X-Hashcash header before /token/valid or
+// /token/invalid will mint a token.
+type HashcashChallenge struct {
+	Resource string `json:"resource"`
+	Bits     int    `json:"bits"`
+	Expires  int64  `json:"expires"`
+	Nonce    string `json:"nonce"`
+	MAC      string `json:"mac"`
+}
+
+func computeHashcashMAC(resource string, bits int, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, hashcashSecret)
+	fmt.Fprintf(mac, "%s:%d:%d:%s", resource, bits, expires, nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// handleNewHashcash issues a fresh proof-of-work challenge for service_id.
+func handleNewHashcash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ServiceID == "" {
+		http.Error(w, "service_id is required", http.StatusBadRequest)
+		return
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		log.Printf("Error generating hashcash nonce: %v", err)
+		http.Error(w, "Failed to generate challenge", http.StatusInternalServerError)
+		return
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+	expires := time.Now().Add(hashcashChallengeTTL).Unix()
+
+	hashcashChallengesIssued.Inc()
+	log.Printf("Issued hashcash challenge for service: %s (bits=%d)", req.ServiceID, hashcashDifficultyBits)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HashcashChallenge{
+		Resource: req.ServiceID,
+		Bits:     hashcashDifficultyBits,
+		Expires:  expires,
+		Nonce:    nonce,
+		MAC:      computeHashcashMAC(req.ServiceID, hashcashDifficultyBits, expires, nonce),
+	})
+}
+
+// hashcashNonceCache rejects a second presentation of an already-spent
+// hashcash solution, evicting the oldest entry once full rather than
+// growing without bound.
+type hashcashNonceCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var hashcashSeenNonces = &hashcashNonceCache{
+	order:   list.New(),
+	entries: make(map[string]*list.Element),
+}
+
+// checkAndRemember reports whether nonce is still unspent (true) and, if
+// so, marks it spent; it returns false for a nonce already seen.
+func (c *hashcashNonceCache) checkAndRemember(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, seen := c.entries[nonce]; seen {
+		return false
+	}
+	c.entries[nonce] = c.order.PushBack(nonce)
+	if c.order.Len() > hashcashNonceCacheSize {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+	}
+	return true
+}
+
+// hashcashError is a verifyHashcash failure. reason is a small fixed set of
+// values safe to use as a Prometheus label; message is the human-readable
+// detail returned to the caller.
+type hashcashError struct {
+	reason  string
+	message string
+}
+
+func (e *hashcashError) Error() string { return e.message }
+
+// verifyHashcash validates an X-Hashcash header against serviceID: the
+// header must echo a challenge this service issued for serviceID (MAC
+// check) that hasn't expired or already been spent, and its SHA-256 digest
+// must have at least the requested number of leading zero bits.
+//
+// The stamp format is "1:bits:expires:resource:nonce:mac:counter" - the
+// same fields POST /api/new-hashcash handed out, plus the counter the
+// caller brute-forced until the digest of the whole stamp met the
+// difficulty target.
+func verifyHashcash(header, serviceID string) error {
+	if header == "" {
+		return &hashcashError{"missing", "missing X-Hashcash header"}
+	}
+
+	fields := strings.Split(header, ":")
+	if len(fields) != 7 || fields[0] != "1" {
+		return &hashcashError{"malformed", "malformed hashcash stamp"}
+	}
+	bits, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return &hashcashError{"malformed", fmt.Sprintf("invalid bits: %v", err)}
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return &hashcashError{"malformed", fmt.Sprintf("invalid expires: %v", err)}
+	}
+	resource, nonce, mac := fields[3], fields[4], fields[5]
+
+	if resource != serviceID {
+		return &hashcashError{"resource_mismatch", "hashcash resource does not match service_id"}
+	}
+	if time.Now().Unix() > expires {
+		return &hashcashError{"expired", "hashcash challenge expired"}
+	}
+	expectedMAC := computeHashcashMAC(resource, bits, expires, nonce)
+	if !hmac.Equal([]byte(expectedMAC), []byte(mac)) {
+		return &hashcashError{"mac_mismatch", "hashcash MAC does not match issued challenge"}
+	}
+	if !hashcashSeenNonces.checkAndRemember(nonce) {
+		return &hashcashError{"replayed", "hashcash nonce has already been used"}
+	}
+
+	sum := sha256.Sum256([]byte(header))
+	if leadingZeroBits(sum[:]) < bits {
+		return &hashcashError{"insufficient_difficulty", "hashcash stamp does not meet required difficulty"}
+	}
+	return nil
+}
+
+// leadingZeroBits counts digest's leading zero bits, most significant byte
+// first.
+func leadingZeroBits(digest []byte) int {
+	count := 0
+	for _, b := range digest {
+		if b == 0 {
+			count += 8
+			continue
+		}
+		for mask := byte(0x80); mask > 0; mask >>= 1 {
+			if b&mask != 0 {
+				return count
+			}
+			count++
+		}
+	}
+	return count
+}
+
 // handleValidToken generates a valid JWT token
 func handleValidToken(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -95,18 +503,34 @@ func handleValidToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenString, err := generateToken(req.ServiceID, validPrivateKey)
+	if err := verifyHashcash(r.Header.Get("X-Hashcash"), req.ServiceID); err != nil {
+		hcErr := err.(*hashcashError)
+		hashcashRejections.WithLabelValues(hcErr.reason).Inc()
+		http.Error(w, fmt.Sprintf("hashcash challenge required: %v", err), http.StatusTooManyRequests)
+		return
+	}
+
+	keyMu.RLock()
+	signingKey, kid := validPrivateKey, currentKID
+	keyMu.RUnlock()
+
+	tokenString, err := generateToken(req.ServiceID, signingKey, kid, req.JWK)
 	if err != nil {
 		log.Printf("Error generating valid token: %v", err)
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Generated valid token for service: %s", req.ServiceID)
+	if req.JWK != nil {
+		log.Printf("Generated valid token for service: %s (kid=%s, bound to jkt=%s)", req.ServiceID, kid, ecJWKThumbprint(*req.JWK))
+	} else {
+		log.Printf("Generated valid token for service: %s (kid=%s)", req.ServiceID, kid)
+	}
+	tokensIssued.WithLabelValues("valid").Inc()
 
 	response := TokenResponse{
 		Token:     tokenString,
-		ExpiresIn: 300, // 5 minutes
+		ExpiresIn: int64(tokenTTL.Seconds()),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -131,8 +555,16 @@ func handleInvalidToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Sign with the invalid private key
-	tokenString, err := generateToken(req.ServiceID, invalidPrivateKey)
+	if err := verifyHashcash(r.Header.Get("X-Hashcash"), req.ServiceID); err != nil {
+		hcErr := err.(*hashcashError)
+		hashcashRejections.WithLabelValues(hcErr.reason).Inc()
+		http.Error(w, fmt.Sprintf("hashcash challenge required: %v", err), http.StatusTooManyRequests)
+		return
+	}
+
+	// Sign with the invalid private key, tagged with its own (unpublished) kid
+	// so it never resolves against the JWKS.
+	tokenString, err := generateToken(req.ServiceID, invalidPrivateKey, keyID(&invalidPrivateKey.PublicKey), req.JWK)
 	if err != nil {
 		log.Printf("Error generating invalid token: %v", err)
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
@@ -140,16 +572,200 @@ func handleInvalidToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Generated invalid token for service: %s", req.ServiceID)
+	tokensIssued.WithLabelValues("invalid").Inc()
 
 	response := TokenResponse{
 		Token:     tokenString,
-		ExpiresIn: 300, // 5 minutes
+		ExpiresIn: int64(tokenTTL.Seconds()),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// revokedJTIs tracks revoked token IDs until they would have expired anyway,
+// so a POST /revoke takes effect immediately instead of waiting for clients
+// to notice at next refresh.
+var (
+	revokeMu sync.Mutex
+	revoked  = make(map[string]time.Time) // jti -> original expiry
+)
+
+// revokeJTI marks jti as revoked until expiresAt, beyond which the token
+// would be rejected as expired anyway and the entry can be forgotten.
+func revokeJTI(jti string, expiresAt time.Time) {
+	revokeMu.Lock()
+	defer revokeMu.Unlock()
+	for k, exp := range revoked {
+		if time.Now().After(exp) {
+			delete(revoked, k)
+		}
+	}
+	revoked[jti] = expiresAt
+}
+
+func isRevoked(jti string) bool {
+	revokeMu.Lock()
+	defer revokeMu.Unlock()
+	exp, ok := revoked[jti]
+	if !ok {
+		return false
+	}
+	if time.Now().After(exp) {
+		delete(revoked, jti)
+		return false
+	}
+	return true
+}
+
+// verifyOwnToken verifies a token's RS256 signature against the vending
+// service's own current or (during the post-rotation grace period)
+// previous key, without caring what audience it was issued for - this backs
+// /introspect and /revoke, which operate on any token this service signed.
+func verifyOwnToken(tokenString string) (*JWTClaims, error) {
+	claims := &JWTClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %s", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+
+		keyMu.RLock()
+		defer keyMu.RUnlock()
+		if kid == currentKID {
+			return validPublicKey, nil
+		}
+		if kid != "" && kid == previousKID && previousPubKey != nil {
+			return previousPubKey, nil
+		}
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// IntrospectionRequest is the request body for POST /introspect.
+type IntrospectionRequest struct {
+	Token string `json:"token"`
+}
+
+// IntrospectionResponse follows the OAuth 2.0 Token Introspection (RFC 7662)
+// response shape.
+type IntrospectionResponse struct {
+	Active bool   `json:"active"`
+	Sub    string `json:"sub,omitempty"`
+	Iss    string `json:"iss,omitempty"`
+	Aud    string `json:"aud,omitempty"`
+	Exp    int64  `json:"exp,omitempty"`
+	Jti    string `json:"jti,omitempty"`
+	Cnf    *Cnf   `json:"cnf,omitempty"`
+}
+
+// handleIntrospect implements OAuth 2.0 Token Introspection (RFC 7662):
+// given a token, report whether it's still active (valid signature,
+// unexpired, and not revoked) and, if so, its claims.
+func handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authenticateAdmin(r) {
+		http.Error(w, "missing or invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var req IntrospectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, err := verifyOwnToken(req.Token)
+	if err != nil {
+		log.Printf("introspection: token failed verification: %v", err)
+		introspections.WithLabelValues("inactive").Inc()
+		json.NewEncoder(w).Encode(IntrospectionResponse{Active: false})
+		return
+	}
+
+	if isRevoked(claims.ID) {
+		log.Printf("introspection: token jti=%s has been revoked", claims.ID)
+		introspections.WithLabelValues("inactive").Inc()
+		json.NewEncoder(w).Encode(IntrospectionResponse{Active: false})
+		return
+	}
+
+	resp := IntrospectionResponse{
+		Active: true,
+		Sub:    claims.Subject,
+		Iss:    claims.Issuer,
+		Jti:    claims.ID,
+		Cnf:    claims.Cnf,
+	}
+	if len(claims.Audience) > 0 {
+		resp.Aud = claims.Audience[0]
+	}
+	if claims.ExpiresAt != nil {
+		resp.Exp = claims.ExpiresAt.Unix()
+	}
+
+	log.Printf("introspection: token jti=%s sub=%s is active", claims.ID, claims.Subject)
+	introspections.WithLabelValues("active").Inc()
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RevokeRequest is the request body for POST /revoke.
+type RevokeRequest struct {
+	Token string `json:"token"`
+}
+
+// handleRevoke implements OAuth 2.0 Token Revocation (RFC 7009): once
+// revoked, a token's jti fails introspection immediately, regardless of how
+// much of its original lifetime remains.
+func handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authenticateAdmin(r) {
+		http.Error(w, "missing or invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var req RevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := verifyOwnToken(req.Token)
+	if err != nil {
+		// RFC 7009: revoking a token that's already invalid isn't an error.
+		log.Printf("revoke: ignoring unverifiable token: %v", err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	expiresAt := time.Now().Add(tokenTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	revokeJTI(claims.ID, expiresAt)
+	revocations.Inc()
+	log.Printf("revoke: revoked token jti=%s sub=%s", claims.ID, claims.Subject)
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // handlePublicKey returns the public key in PEM format for token validation
 func handlePublicKey(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -157,8 +773,12 @@ func handlePublicKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keyMu.RLock()
+	pub := validPublicKey
+	keyMu.RUnlock()
+
 	// Export public key as PEM
-	pubKeyBytes, err := jwt.MarshalRSAPublicKey(validPublicKey)
+	pubKeyBytes, err := jwt.MarshalRSAPublicKey(pub)
 	if err != nil {
 		log.Printf("Error marshaling public key: %v", err)
 		http.Error(w, "Failed to export public key", http.StatusInternalServerError)
@@ -169,6 +789,26 @@ func handlePublicKey(w http.ResponseWriter, r *http.Request) {
 	w.Write(pubKeyBytes)
 }
 
+// handleJWKS serves the JWK Set containing the current signing key and,
+// during the post-rotation grace period, the previous one so tokens issued
+// just before a rotation keep validating.
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyMu.RLock()
+	keys := []JWK{jwkFromPublicKey(validPublicKey, currentKID)}
+	if previousPubKey != nil {
+		keys = append(keys, jwkFromPublicKey(previousPubKey, previousKID))
+	}
+	keyMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JWKSet{Keys: keys})
+}
+
 // handleHealth returns health status
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -176,20 +816,32 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	startKeyRotation()
+
 	http.HandleFunc("/token/valid", handleValidToken)
 	http.HandleFunc("/token/invalid", handleInvalidToken)
+	http.HandleFunc("/api/new-hashcash", handleNewHashcash)
 	http.HandleFunc("/public-key", handlePublicKey)
+	http.HandleFunc("/.well-known/jwks.json", handleJWKS)
+	http.HandleFunc("/introspect", handleIntrospect)
+	http.HandleFunc("/revoke", handleRevoke)
 	http.HandleFunc("/health", handleHealth)
+	http.Handle("/metrics", promhttp.Handler())
 
 	port := ":8081"
 	log.Printf("JWT Vending Service starting on port %s", port)
 	log.Printf("Endpoints:")
-	log.Printf("  POST /token/valid - Generate valid JWT")
-	log.Printf("  POST /token/invalid - Generate invalid JWT")
+	log.Printf("  POST /token/valid - Generate valid JWT (requires X-Hashcash)")
+	log.Printf("  POST /token/invalid - Generate invalid JWT (requires X-Hashcash)")
+	log.Printf("  POST /api/new-hashcash - Issue a proof-of-work challenge")
 	log.Printf("  GET /public-key - Get public key for validation")
+	log.Printf("  GET /.well-known/jwks.json - Get JWK Set for validation (supports key rotation)")
+	log.Printf("  POST /introspect - Token introspection (RFC 7662)")
+	log.Printf("  POST /revoke - Token revocation (RFC 7009)")
 	log.Printf("  GET /health - Health check")
+	log.Printf("  GET /metrics - Prometheus metrics")
 
 	if err := http.ListenAndServe(port, nil); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
-}
\ No newline at end of file
+}
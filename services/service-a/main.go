@@ -2,13 +2,39 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// auditLog is the structured JSON logger used for audit-relevant events
+// (requests in/out, token fetches, decisions). Startup/diagnostic messages
+// still go through the standard "log" package.
+var auditLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+var (
+	jwtFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "jwt_fetch_duration_seconds",
+		Help: "Duration of token requests to the JWT vending service.",
+	})
+	serviceBRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "service_b_requests_total",
+		Help: "Count of calls to service B, by outcome status.",
+	}, []string{"status"})
 )
 
 // CallServiceBRequest represents the request to call service B
@@ -48,13 +74,119 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-// getJWTToken fetches a JWT token from the vending service
-func getJWTToken(useValid bool) (string, error) {
+// generateTraceparent creates a new W3C Trace Context header value. Used
+// when an inbound request doesn't already carry one, so every request we
+// originate can still be correlated across service-a, service-b, and the
+// WASM filters sitting in front of them.
+func generateTraceparent() string {
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	rand.Read(traceID)
+	rand.Read(spanID)
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceID), hex.EncodeToString(spanID))
+}
+
+// traceID extracts the trace-id component from a traceparent header value
+// for logging, returning the raw value unchanged if it's malformed.
+func traceID(traceparent string) string {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 {
+		return traceparent
+	}
+	return parts[1]
+}
+
+// hashcashChallenge mirrors the vending service's POST /api/new-hashcash
+// response: a proof-of-work puzzle tied to this service's ID that must be
+// solved and echoed back via X-Hashcash before a token request will succeed.
+type hashcashChallenge struct {
+	Resource string `json:"resource"`
+	Bits     int    `json:"bits"`
+	Expires  int64  `json:"expires"`
+	Nonce    string `json:"nonce"`
+	MAC      string `json:"mac"`
+}
+
+// fetchHashcashChallenge requests a fresh proof-of-work challenge for
+// serviceID from the vending service.
+func fetchHashcashChallenge(traceparent string) (hashcashChallenge, error) {
+	jsonData, err := json.Marshal(TokenRequest{ServiceID: serviceID})
+	if err != nil {
+		return hashcashChallenge{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, jwtVendingServiceURL+"/api/new-hashcash", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return hashcashChallenge{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", traceparent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return hashcashChallenge{}, fmt.Errorf("failed to request hashcash challenge: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return hashcashChallenge{}, fmt.Errorf("hashcash challenge request returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var challenge hashcashChallenge
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return hashcashChallenge{}, fmt.Errorf("failed to decode hashcash challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// solveHashcash brute-forces a counter until the SHA-256 digest of the full
+// stamp string has at least challenge.Bits leading zero bits, then returns
+// the solved stamp ready to go in an X-Hashcash header.
+func solveHashcash(challenge hashcashChallenge) string {
+	prefix := fmt.Sprintf("1:%d:%d:%s:%s:%s:", challenge.Bits, challenge.Expires, challenge.Resource, challenge.Nonce, challenge.MAC)
+	for counter := uint64(0); ; counter++ {
+		stamp := prefix + strconv.FormatUint(counter, 10)
+		sum := sha256.Sum256([]byte(stamp))
+		if leadingZeroBits(sum[:]) >= challenge.Bits {
+			return stamp
+		}
+	}
+}
+
+// leadingZeroBits counts digest's leading zero bits, most significant byte
+// first.
+func leadingZeroBits(digest []byte) int {
+	count := 0
+	for _, b := range digest {
+		if b == 0 {
+			count += 8
+			continue
+		}
+		for mask := byte(0x80); mask > 0; mask >>= 1 {
+			if b&mask != 0 {
+				return count
+			}
+			count++
+		}
+	}
+	return count
+}
+
+// getJWTToken fetches a JWT token from the vending service, solving a
+// hashcash proof-of-work challenge first since minting is gated on one.
+func getJWTToken(useValid bool, traceparent string) (string, error) {
 	endpoint := "/token/valid"
 	if !useValid {
 		endpoint = "/token/invalid"
 	}
 
+	challenge, err := fetchHashcashChallenge(traceparent)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch hashcash challenge: %w", err)
+	}
+	stamp := solveHashcash(challenge)
+
 	reqBody := TokenRequest{
 		ServiceID: serviceID,
 	}
@@ -67,7 +199,17 @@ func getJWTToken(useValid bool) (string, error) {
 	url := jwtVendingServiceURL + endpoint
 	log.Printf("Requesting JWT from: %s", url)
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", traceparent)
+	req.Header.Set("X-Hashcash", stamp)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	jwtFetchDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		return "", fmt.Errorf("failed to call JWT vending service: %w", err)
 	}
@@ -88,7 +230,7 @@ func getJWTToken(useValid bool) (string, error) {
 }
 
 // callServiceB makes a request to service B with the JWT token
-func callServiceB(asset, token string) (map[string]interface{}, error) {
+func callServiceB(asset, token, traceparent string) (map[string]interface{}, error) {
 	url := fmt.Sprintf("%s/process?asset=%s", serviceBURL, asset)
 	log.Printf("Calling service B: %s", url)
 
@@ -100,6 +242,7 @@ func callServiceB(asset, token string) (map[string]interface{}, error) {
 	// Add JWT token to Authorization header
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("X-Service-ID", serviceID)
+	req.Header.Set("traceparent", traceparent)
 
 	client := &http.Client{
 		Timeout: 10 * time.Second,
@@ -153,12 +296,27 @@ func handleCallServiceB(w http.ResponseWriter, r *http.Request) {
 		req.Asset = "asset-x"
 	}
 
+	traceparent := r.Header.Get("traceparent")
+	if traceparent == "" {
+		traceparent = generateTraceparent()
+	}
+
+	start := time.Now()
 	log.Printf("Processing request to call service B (asset: %s, use_valid_token: %t)", req.Asset, req.UseValidToken)
 
 	// Step 1: Get JWT token
-	token, err := getJWTToken(req.UseValidToken)
+	token, err := getJWTToken(req.UseValidToken, traceparent)
 	if err != nil {
 		log.Printf("Error getting JWT token: %v", err)
+		serviceBRequests.WithLabelValues("jwt_error").Inc()
+		auditLog.Info("call_service_b",
+			"trace_id", traceID(traceparent),
+			"principal", serviceID,
+			"asset", req.Asset,
+			"decision", "error",
+			"reason", err.Error(),
+			"latency_ms", time.Since(start).Milliseconds(),
+		)
 		response := CallServiceBResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Failed to get JWT token: %v", err),
@@ -170,7 +328,23 @@ func handleCallServiceB(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Step 2: Call service B with the token
-	result, err := callServiceB(req.Asset, token)
+	result, err := callServiceB(req.Asset, token, traceparent)
+	status := "ok"
+	reason := "allowed"
+	if err != nil {
+		status = "error"
+		reason = err.Error()
+	}
+	serviceBRequests.WithLabelValues(status).Inc()
+	auditLog.Info("call_service_b",
+		"trace_id", traceID(traceparent),
+		"principal", serviceID,
+		"asset", req.Asset,
+		"decision", status,
+		"reason", reason,
+		"latency_ms", time.Since(start).Milliseconds(),
+	)
+
 	if err != nil {
 		log.Printf("Error calling service B: %v", err)
 		response := CallServiceBResponse{
@@ -203,6 +377,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 func main() {
 	http.HandleFunc("/call-service-b", handleCallServiceB)
 	http.HandleFunc("/health", handleHealth)
+	http.Handle("/metrics", promhttp.Handler())
 
 	port := ":8080"
 	log.Printf("Service A starting on port %s", port)
@@ -212,6 +387,7 @@ func main() {
 	log.Printf("Endpoints:")
 	log.Printf("  POST /call-service-b - Call service B with JWT")
 	log.Printf("  GET /health - Health check")
+	log.Printf("  GET /metrics - Prometheus metrics")
 
 	if err := http.ListenAndServe(port, nil); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
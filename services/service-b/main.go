@@ -1,14 +1,42 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
+	"math/big"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// auditLog is the structured JSON logger used for audit-relevant events
+// (requests processed, JWT/DPoP verification outcomes). Startup/diagnostic
+// messages still go through the standard "log" package.
+var auditLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+var (
+	serviceBRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "service_b_requests_total",
+		Help: "Count of requests handled by service B, by outcome status.",
+	}, []string{"status"})
+	jwtCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_cache_hits_total",
+		Help: "Count of JWKS cache lookups, by hit or miss.",
+	}, []string{"result"})
 )
 
 // ServiceBResponse represents the response from service B
@@ -27,7 +55,10 @@ type ErrorResponse struct {
 }
 
 var (
-	serviceID = getEnv("SERVICE_ID", "service-b")
+	serviceID        = getEnv("SERVICE_ID", "service-b")
+	jwtVendingURL    = getEnv("JWT_VENDING_URL", "http://jwt-vending-service:8081")
+	expectedIssuer   = "jwt-vending-service"
+	expectedAudience = "service-mesh"
 )
 
 func getEnv(key, defaultValue string) string {
@@ -37,6 +68,271 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// jwk mirrors the subset of RFC 7517 fields the vending service publishes.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwksCache fetches and caches the vending service's JWKS, refreshing it
+// whenever a `kid` we haven't seen shows up (e.g. right after key rotation).
+type jwksCache struct {
+	mu   sync.RWMutex
+	keys map[string]*rsa.PublicKey
+}
+
+var jwtKeys = &jwksCache{keys: make(map[string]*rsa.PublicKey)}
+
+func (c *jwksCache) get(kid string) (*rsa.PublicKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	c.mu.RUnlock()
+	if ok {
+		jwtCacheHits.WithLabelValues("hit").Inc()
+		return key, nil
+	}
+
+	jwtCacheHits.WithLabelValues("miss").Inc()
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	key, ok = c.keys[kid]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) refresh() error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(jwtVendingURL + "/.well-known/jwks.json")
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		pub, err := jwkToRSAPublicKey(k)
+		if err != nil {
+			log.Printf("skipping malformed JWK kid=%s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+func jwkToRSAPublicKey(k jwk) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid n: %w", err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid e: %w", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
+
+// keyfunc is the jwt.Keyfunc used by parseJWT: it rejects alg=none, reads
+// the `kid` header set by the vending service, and resolves it against the
+// cached JWKS (refreshing on a cache miss to pick up rotated keys).
+func keyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+	}
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, fmt.Errorf("token missing kid header")
+	}
+
+	return jwtKeys.get(kid)
+}
+
+const dpopMaxSkewSeconds = 60
+
+// dpopReplayCache rejects a DPoP proof whose jti we've already seen within
+// the skew window, closing the window a copied proof could otherwise be
+// replayed in.
+type dpopReplayCache struct {
+	mu   sync.Mutex
+	seen map[string]int64
+}
+
+var dpopSeenJTIs = &dpopReplayCache{seen: make(map[string]int64)}
+
+func (c *dpopReplayCache) checkAndRemember(jti string, expiresAt int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().Unix()
+	for k, exp := range c.seen {
+		if exp < now {
+			delete(c.seen, k)
+		}
+	}
+
+	if exp, ok := c.seen[jti]; ok && exp >= now {
+		return fmt.Errorf("jti %q already used", jti)
+	}
+	c.seen[jti] = expiresAt
+	return nil
+}
+
+// ecJWK mirrors the public EC JWK the client filter embeds in each DPoP
+// proof header (RFC 7517 "EC" key type).
+type ecJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ecJWKThumbprint computes the RFC 7638 JWK thumbprint the vending service
+// binds into a DPoP-bound token's cnf.jkt claim.
+func ecJWKThumbprint(k ecJWK) string {
+	thumbprintInput := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k.Crv, k.Kty, k.X, k.Y)
+	sum := sha256.Sum256([]byte(thumbprintInput))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func jwkToECDSAPublicKey(k ecJWK) (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported DPoP key type %s/%s", k.Kty, k.Crv)
+	}
+	xBytes, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %w", err)
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y: %w", err)
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}, nil
+}
+
+// verifyDPoPProof validates the DPoP header (RFC 9449) against the request
+// it was attached to and the cnf.jkt claim of the already-verified bearer
+// token: the proof must be a fresh, correctly-signed ES256 JWS over this
+// method and URL, and its embedded key must hash to the thumbprint the
+// vending service bound into the token.
+func verifyDPoPProof(proof, method, url, expectedJKT string) error {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed DPoP proof")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid DPoP header encoding: %w", err)
+	}
+	var header struct {
+		Typ string `json:"typ"`
+		Alg string `json:"alg"`
+		JWK ecJWK  `json:"jwk"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("invalid DPoP header: %w", err)
+	}
+	if header.Typ != "dpop+jwt" {
+		return fmt.Errorf("unexpected DPoP typ %q", header.Typ)
+	}
+	if header.Alg != "ES256" {
+		return fmt.Errorf("unsupported DPoP alg %q", header.Alg)
+	}
+
+	if jkt := ecJWKThumbprint(header.JWK); jkt != expectedJKT {
+		return fmt.Errorf("DPoP key thumbprint does not match token's cnf.jkt")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid DPoP claims encoding: %w", err)
+	}
+	var claims struct {
+		Htm string `json:"htm"`
+		Htu string `json:"htu"`
+		Iat int64  `json:"iat"`
+		Jti string `json:"jti"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return fmt.Errorf("invalid DPoP claims: %w", err)
+	}
+	if claims.Htm != method {
+		return fmt.Errorf("DPoP htm %q does not match request method %q", claims.Htm, method)
+	}
+	if claims.Htu != url {
+		return fmt.Errorf("DPoP htu %q does not match request URL %q", claims.Htu, url)
+	}
+	if claims.Jti == "" {
+		return fmt.Errorf("DPoP proof missing jti")
+	}
+
+	now := time.Now().Unix()
+	if skew := claims.Iat - now; skew > dpopMaxSkewSeconds || -skew > dpopMaxSkewSeconds {
+		return fmt.Errorf("DPoP proof iat %d outside allowed skew", claims.Iat)
+	}
+	if err := dpopSeenJTIs.checkAndRemember(claims.Jti, claims.Iat+dpopMaxSkewSeconds); err != nil {
+		return err
+	}
+
+	pub, err := jwkToECDSAPublicKey(header.JWK)
+	if err != nil {
+		return fmt.Errorf("invalid DPoP key: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid DPoP signature encoding: %w", err)
+	}
+	if len(sig) != 64 {
+		return fmt.Errorf("invalid DPoP signature length")
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, hashed[:], r, s) {
+		return fmt.Errorf("DPoP signature verification failed")
+	}
+
+	return nil
+}
+
 // extractJWT extracts the JWT token from the Authorization header
 func extractJWT(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
@@ -52,20 +348,54 @@ func extractJWT(r *http.Request) (string, error) {
 	return parts[1], nil
 }
 
-// parseJWT parses and validates the JWT token (basic parsing without verification)
-// In production, this would verify the signature using the public key
-func parseJWT(tokenString string) (jwt.MapClaims, error) {
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+// parseJWT parses and verifies the JWT token against the vending service's
+// JWKS, rejecting tokens signed with alg=none or an unrecognized kid. It
+// also returns the token's kid header for audit logging.
+func parseJWT(tokenString string) (jwt.MapClaims, string, error) {
+	token, err := jwt.ParseWithClaims(tokenString, jwt.MapClaims{}, keyfunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(expectedIssuer),
+		jwt.WithAudience(expectedAudience),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse JWT: %w", err)
+		return nil, "", fmt.Errorf("failed to verify JWT: %w", err)
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid JWT claims")
+	if !ok || !token.Valid {
+		return nil, "", fmt.Errorf("invalid JWT claims")
 	}
 
-	return claims, nil
+	kid, _ := token.Header["kid"].(string)
+	return claims, kid, nil
+}
+
+// requestTraceID extracts the trace-id component from an inbound
+// traceparent header for logging, returning the raw value unchanged if
+// it's absent or malformed.
+func requestTraceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 {
+		return r.Header.Get("traceparent")
+	}
+	return parts[1]
+}
+
+// denyProcess writes an error response for handleProcess and emits the
+// matching audit record and metric.
+func denyProcess(w http.ResponseWriter, r *http.Request, start time.Time, asset, callerID, reason string, status int, resp ErrorResponse) {
+	serviceBRequests.WithLabelValues("denied").Inc()
+	auditLog.Info("process_request",
+		"trace_id", requestTraceID(r),
+		"principal", callerID,
+		"asset", asset,
+		"decision", "Deny",
+		"reason", reason,
+		"latency_ms", time.Since(start).Milliseconds(),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
 }
 
 // handleProcess handles requests to service B
@@ -77,6 +407,8 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
+
 	// Get asset from query parameter
 	asset := r.URL.Query().Get("asset")
 	if asset == "" {
@@ -89,12 +421,8 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 	// Extract JWT token from Authorization header
 	tokenString, err := extractJWT(r)
 	if err != nil {
-		log.Printf("Error extracting JWT: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(ErrorResponse{
-			Error: fmt.Sprintf("Unauthorized: %v", err),
-		})
+		denyProcess(w, r, start, asset, callerID, err.Error(), http.StatusUnauthorized,
+			ErrorResponse{Error: fmt.Sprintf("Unauthorized: %v", err)})
 		return
 	}
 
@@ -102,28 +430,43 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 
 	// Parse JWT claims (without verification for demo purposes)
 	// In production, the WASM module validates the JWT signature
-	claims, err := parseJWT(tokenString)
+	claims, kid, err := parseJWT(tokenString)
 	if err != nil {
-		log.Printf("Error parsing JWT: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(ErrorResponse{
-			Error: fmt.Sprintf("Invalid JWT: %v", err),
-		})
+		denyProcess(w, r, start, asset, callerID, err.Error(), http.StatusUnauthorized,
+			ErrorResponse{Error: fmt.Sprintf("Invalid JWT: %v", err)})
 		return
 	}
 
 	log.Printf("JWT claims parsed: sub=%v, iss=%v", claims["sub"], claims["iss"])
 
+	// A token minted with a cnf.jkt claim is DPoP-bound: the caller must
+	// additionally prove possession of the matching private key via a
+	// fresh per-request DPoP proof, or the bearer token alone is useless
+	// to whoever might have intercepted it.
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		jkt, _ := cnf["jkt"].(string)
+		dpopProof := r.Header.Get("DPoP")
+		if dpopProof == "" {
+			denyProcess(w, r, start, asset, callerID, "missing DPoP proof for DPoP-bound token", http.StatusUnauthorized,
+				ErrorResponse{Error: "Unauthorized: missing DPoP proof for DPoP-bound token"})
+			return
+		}
+
+		htu := fmt.Sprintf("http://%s%s", r.Host, r.URL.Path)
+		if err := verifyDPoPProof(dpopProof, r.Method, htu, jkt); err != nil {
+			denyProcess(w, r, start, asset, callerID, err.Error(), http.StatusUnauthorized,
+				ErrorResponse{Error: fmt.Sprintf("Unauthorized: %v", err)})
+			return
+		}
+		log.Printf("DPoP proof verified for jkt=%s", jkt)
+	}
+
 	// Check if authorization header indicates this was validated by WASM filter
 	// The WASM filter would add custom headers after PDP validation
 	pdpDecision := r.Header.Get("X-PDP-Decision")
 	if pdpDecision == "Deny" {
 		reason := r.Header.Get("X-PDP-Reason")
-		log.Printf("Request denied by PDP: %s", reason)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(ErrorResponse{
+		denyProcess(w, r, start, asset, callerID, reason, http.StatusForbidden, ErrorResponse{
 			Error: "Access denied by policy",
 			PDPResponse: map[string]interface{}{
 				"decision": "Deny",
@@ -148,6 +491,16 @@ func handleProcess(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Request authorized and processed successfully")
+	serviceBRequests.WithLabelValues("allowed").Inc()
+	auditLog.Info("process_request",
+		"trace_id", requestTraceID(r),
+		"principal", callerID,
+		"asset", asset,
+		"decision", "Allow",
+		"reason", "authorized",
+		"latency_ms", time.Since(start).Milliseconds(),
+		"jwt_kid", kid,
+	)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -162,6 +515,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 func main() {
 	http.HandleFunc("/process", handleProcess)
 	http.HandleFunc("/health", handleHealth)
+	http.Handle("/metrics", promhttp.Handler())
 
 	port := ":8083"
 	log.Printf("Service B starting on port %s", port)
@@ -169,6 +523,7 @@ func main() {
 	log.Printf("Endpoints:")
 	log.Printf("  GET /process?asset=<asset-id> - Process request with JWT validation")
 	log.Printf("  GET /health - Health check")
+	log.Printf("  GET /metrics - Prometheus metrics")
 
 	if err := http.ListenAndServe(port, nil); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
@@ -3,9 +3,27 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// auditLog is the structured JSON logger used for audit-relevant events
+// (per-query decisions). Startup/diagnostic messages still go through the
+// standard "log" package.
+var auditLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+var pdpDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdp_decision_total",
+	Help: "Count of policy evaluations, by decision.",
+}, []string{"decision"})
+
 // Principal represents the service making the request
 type Principal struct {
 	ID string `json:"id"` // e.g., "service-a"
@@ -80,6 +98,17 @@ func evaluateAccess(principalID, assetID string) Decision {
 	}
 }
 
+// evaluationTraceID extracts the trace-id component from an inbound
+// traceparent header for logging, returning the raw value unchanged if
+// it's absent or malformed.
+func evaluationTraceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 {
+		return r.Header.Get("traceparent")
+	}
+	return parts[1]
+}
+
 // handleEvaluation handles the POST /access/v2/evaluations endpoint
 func handleEvaluation(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -87,6 +116,8 @@ func handleEvaluation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
+
 	var req EvaluationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("Error decoding request: %v", err)
@@ -107,6 +138,8 @@ func handleEvaluation(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Evaluating access for principal: %s", req.Principal.ID)
 
+	traceID := evaluationTraceID(r)
+
 	// Evaluate each query
 	var decisions []Decision
 	for _, query := range req.Queries {
@@ -115,6 +148,15 @@ func handleEvaluation(w http.ResponseWriter, r *http.Request) {
 				Decision: "Deny",
 				Reason:   "assetId is required",
 			})
+			pdpDecisions.WithLabelValues("Deny").Inc()
+			auditLog.Info("evaluate_access",
+				"trace_id", traceID,
+				"principal", req.Principal.ID,
+				"asset", query.AssetID,
+				"decision", "Deny",
+				"reason", "assetId is required",
+				"latency_ms", time.Since(start).Milliseconds(),
+			)
 			continue
 		}
 
@@ -122,6 +164,16 @@ func handleEvaluation(w http.ResponseWriter, r *http.Request) {
 		log.Printf("  Query: action=%s, assetId=%s -> Decision: %s (%s)",
 			query.Action, query.AssetID, decision.Decision, decision.Reason)
 		decisions = append(decisions, decision)
+
+		pdpDecisions.WithLabelValues(decision.Decision).Inc()
+		auditLog.Info("evaluate_access",
+			"trace_id", traceID,
+			"principal", req.Principal.ID,
+			"asset", query.AssetID,
+			"decision", decision.Decision,
+			"reason", decision.Reason,
+			"latency_ms", time.Since(start).Milliseconds(),
+		)
 	}
 
 	response := EvaluationResponse{
@@ -156,6 +208,7 @@ func main() {
 	http.HandleFunc("/access/v2/evaluations", handleEvaluation)
 	http.HandleFunc("/health", handleHealth)
 	http.HandleFunc("/policies", handlePolicies)
+	http.Handle("/metrics", promhttp.Handler())
 
 	port := ":8082"
 	log.Printf("Mock SGNL PDP Service starting on port %s", port)
@@ -163,6 +216,7 @@ func main() {
 	log.Printf("  POST /access/v2/evaluations - Evaluate authorization")
 	log.Printf("  GET /health - Health check")
 	log.Printf("  GET /policies - View current policy rules")
+	log.Printf("  GET /metrics - Prometheus metrics")
 	log.Printf("")
 	log.Printf("Policy Rules:")
 	log.Printf("  service-a -> asset-x: ALLOW")
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
@@ -11,12 +23,58 @@ import (
 const (
 	jwtVendingServiceCluster = "jwt-vending-service"
 	jwtVendingServicePath    = "/token/valid"
+	hashcashChallengePath    = "/api/new-hashcash"
+	jwksServicePath          = "/.well-known/jwks.json"
+	jwksAuthority            = "jwt-vending-service:8081"
+
+	// jwksSharedDataKey is where the plugin-wide JWKS cache is stored via
+	// proxywasm.SetSharedData so every httpContext on this VM sees the same
+	// keys without each one having to fetch them.
+	jwksSharedDataKey = "client_filter_jwks"
+
+	// jwksRefreshPeriodMs controls how often OnTick re-fetches the JWKS, so
+	// a rotated key shows up here shortly after the vending service starts
+	// publishing it.
+	jwksRefreshPeriodMs = 60000
+
+	expectedIssuer   = "jwt-vending-service"
+	expectedAudience = "service-mesh"
+
+	clientServiceID = "service-a"
+
+	// negativeCacheTTLSeconds bounds how long we remember "the vending
+	// service errored" so a misbehaving upstream can't turn every request
+	// into a synchronous callout.
+	negativeCacheTTLSeconds = 5
+
+	// proactiveRefreshWindowSeconds triggers a background token refresh
+	// once a cached token is within this many seconds of expiry.
+	proactiveRefreshWindowSeconds = 15
+
+	// pendingTTLSeconds bounds how long a "fetch in flight" marker is
+	// trusted; past this we assume the original fetcher died without
+	// cleaning up and let the next request take over.
+	pendingTTLSeconds = 5
+
+	// dpopKeySharedDataKey stores this filter's ECDSA P-256 proof-of-
+	// possession keypair (RFC 9449) so every httpContext - and every worker
+	// thread sharing this VM's shared data - signs DPoP proofs with the
+	// same key and advertises the same public JWK to the vending service.
+	dpopKeySharedDataKey = "client_filter_dpop_key"
 )
 
 func main() {
 	proxywasm.SetVMContext(&vmContext{})
 }
 
+// Metrics, defined once in OnPluginStart since metric IDs are VM-wide.
+var (
+	tokenFetchDispatchedMetric proxywasm.MetricCounter
+	jwtCacheHitMetric          proxywasm.MetricCounter
+	jwtCacheMissMetric         proxywasm.MetricCounter
+	jwtVerifyFailureMetric     proxywasm.MetricCounter
+)
+
 // vmContext implements types.VMContext
 type vmContext struct {
 	types.DefaultVMContext
@@ -28,10 +86,75 @@ func (*vmContext) NewPluginContext(contextID uint32) types.PluginContext {
 }
 
 // pluginContext implements types.PluginContext
+// It owns the JWKS cache: fetched once on startup and refreshed on every
+// tick so the filter can verify tokens signed with a just-rotated key
+// without a per-request callout.
 type pluginContext struct {
 	types.DefaultPluginContext
 }
 
+// OnPluginStart implements types.PluginContext
+func (ctx *pluginContext) OnPluginStart(pluginConfigurationSize int) types.OnPluginStartStatus {
+	if err := proxywasm.SetTickPeriodMilliSeconds(jwksRefreshPeriodMs); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to set tick period: %v", err)
+	}
+	tokenFetchDispatchedMetric = proxywasm.DefineCounterMetric("client_filter_token_fetch_dispatched_total")
+	jwtCacheHitMetric = proxywasm.DefineCounterMetric("client_filter_jwt_cache_hit_total")
+	jwtCacheMissMetric = proxywasm.DefineCounterMetric("client_filter_jwt_cache_miss_total")
+	jwtVerifyFailureMetric = proxywasm.DefineCounterMetric("client_filter_jwt_verify_failure_total")
+	ctx.fetchJWKS()
+	if _, err := loadDPoPKey(); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to provision DPoP key: %v", err)
+	}
+	return types.OnPluginStartStatusOK
+}
+
+// OnTick implements types.PluginContext
+func (ctx *pluginContext) OnTick() {
+	ctx.fetchJWKS()
+}
+
+// fetchJWKS dispatches a callout to the vending service's JWKS endpoint and
+// stashes the raw response body in shared data for every httpContext to read.
+func (ctx *pluginContext) fetchJWKS() {
+	headers := [][2]string{
+		{":method", "GET"},
+		{":path", jwksServicePath},
+		{":authority", jwksAuthority},
+	}
+
+	_, err := proxywasm.DispatchHttpCall(
+		jwtVendingServiceCluster,
+		headers,
+		nil,
+		nil,
+		5000,
+		ctx.handleJWKSResponse,
+	)
+	if err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to dispatch JWKS callout: %v", err)
+	}
+}
+
+func (ctx *pluginContext) handleJWKSResponse(numHeaders, bodySize, numTrailers int) {
+	body, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to read JWKS response: %v", err)
+		return
+	}
+
+	_, cas, err := proxywasm.GetSharedData(jwksSharedDataKey)
+	if err != nil {
+		// Key doesn't exist yet; cas 0 creates it.
+		cas = 0
+	}
+	if err := proxywasm.SetSharedData(jwksSharedDataKey, body, cas); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to cache JWKS: %v", err)
+		return
+	}
+	proxywasm.LogInfof("[Client WASM] refreshed JWKS cache (%d bytes)", len(body))
+}
+
 // NewHttpContext implements types.PluginContext
 func (*pluginContext) NewHttpContext(contextID uint32) types.HttpContext {
 	return &httpContext{contextID: contextID}
@@ -41,8 +164,15 @@ func (*pluginContext) NewHttpContext(contextID uint32) types.HttpContext {
 // This filter runs on service-a's Envoy sidecar and intercepts outbound requests
 type httpContext struct {
 	types.DefaultHttpContext
-	contextID uint32
-	token     string
+	contextID   uint32
+	token       string
+	cacheKey    string
+	traceparent string
+
+	// pendingFetchBackground remembers the background argument the current
+	// token fetch was started with, since it has to survive the extra
+	// hashcash-challenge round trip before the real token request goes out.
+	pendingFetchBackground bool
 }
 
 // TokenResponse represents the JWT vending service response
@@ -51,6 +181,229 @@ type TokenResponse struct {
 	ExpiresIn int64  `json:"expires_in"`
 }
 
+// tokenCacheEntry is the shared-data value stored per cache key. Either
+// Token/ExpiresAt are populated (a real token), or Negative is set to
+// remember a recent vending-service failure for negativeCacheTTLSeconds.
+type tokenCacheEntry struct {
+	Token         string `json:"token,omitempty"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+	Negative      bool   `json:"negative,omitempty"`
+	NegativeUntil int64  `json:"negative_until,omitempty"`
+}
+
+// pendingEntry marks an in-flight token fetch for a cache key, along with
+// the contextIDs of requests parked behind it waiting to be resumed once
+// the fetch completes.
+type pendingEntry struct {
+	StartedAt int64    `json:"started_at"`
+	Waiters   []uint32 `json:"waiters"`
+}
+
+// tokenCacheKey builds the shared-data key for a given requesting service
+// ID, target authority, and requested asset/scope.
+func tokenCacheKey(serviceID, authority, asset string) string {
+	return fmt.Sprintf("token_cache|%s|%s|%s", serviceID, authority, asset)
+}
+
+func pendingKey(cacheKey string) string {
+	return cacheKey + "|pending"
+}
+
+// extractAssetFromPath pulls the ?asset= query parameter so tokens can be
+// cached per-asset/scope rather than just per-target-service.
+func extractAssetFromPath(path string) string {
+	parts := strings.Split(path, "asset=")
+	if len(parts) < 2 {
+		return ""
+	}
+	asset := parts[1]
+	if idx := strings.Index(asset, "&"); idx != -1 {
+		asset = asset[:idx]
+	}
+	return asset
+}
+
+// jwk mirrors the subset of RFC 7517 fields the vending service publishes.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// ecJWK is the public half of our EC proof-of-possession keypair in RFC 7517
+// form. It's embedded in every DPoP proof's header and sent to the vending
+// service so it can bind the issued token's cnf.jkt claim to this key.
+type ecJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// dpopKey is the shared-data encoding of our ECDSA P-256 proof-of-possession
+// keypair, fixed-width base64url per coordinate so it round-trips exactly.
+type dpopKey struct {
+	D string `json:"d"`
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+// loadDPoPKey returns this VM's DPoP keypair, generating and publishing one
+// via shared data on first use so every worker thread signs proofs with the
+// same key instead of minting a new identity per thread.
+func loadDPoPKey() (*ecdsa.PrivateKey, error) {
+	raw, cas, err := proxywasm.GetSharedData(dpopKeySharedDataKey)
+	if err == nil && len(raw) > 0 {
+		var stored dpopKey
+		if err := json.Unmarshal(raw, &stored); err == nil {
+			if priv, err := dpopKeyToPrivate(stored); err == nil {
+				return priv, nil
+			}
+		}
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DPoP key: %w", err)
+	}
+
+	marshaled, _ := json.Marshal(privateToDPoPKey(priv))
+	if err := proxywasm.SetSharedData(dpopKeySharedDataKey, marshaled, cas); err != nil {
+		// Lost the race to another worker thread; use whatever it published
+		// rather than have two threads sign with two different keys.
+		raw, _, readErr := proxywasm.GetSharedData(dpopKeySharedDataKey)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read DPoP key after losing race: %w", readErr)
+		}
+		var winner dpopKey
+		if err := json.Unmarshal(raw, &winner); err != nil {
+			return nil, fmt.Errorf("corrupt DPoP key in shared data: %w", err)
+		}
+		return dpopKeyToPrivate(winner)
+	}
+	return priv, nil
+}
+
+func privateToDPoPKey(priv *ecdsa.PrivateKey) dpopKey {
+	d, x, y := make([]byte, 32), make([]byte, 32), make([]byte, 32)
+	priv.D.FillBytes(d)
+	priv.X.FillBytes(x)
+	priv.Y.FillBytes(y)
+	return dpopKey{
+		D: base64.RawURLEncoding.EncodeToString(d),
+		X: base64.RawURLEncoding.EncodeToString(x),
+		Y: base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+func dpopKeyToPrivate(k dpopKey) (*ecdsa.PrivateKey, error) {
+	dBytes, err := base64.RawURLEncoding.DecodeString(k.D)
+	if err != nil {
+		return nil, fmt.Errorf("invalid d: %w", err)
+	}
+	xBytes, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %w", err)
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y: %w", err)
+	}
+	priv := new(ecdsa.PrivateKey)
+	priv.Curve = elliptic.P256()
+	priv.D = new(big.Int).SetBytes(dBytes)
+	priv.X = new(big.Int).SetBytes(xBytes)
+	priv.Y = new(big.Int).SetBytes(yBytes)
+	return priv, nil
+}
+
+// publicJWK returns the public half of priv in the form the vending service
+// and service-b both expect to see embedded in a DPoP proof header.
+func publicJWK(priv *ecdsa.PrivateKey) ecJWK {
+	x, y := make([]byte, 32), make([]byte, 32)
+	priv.X.FillBytes(x)
+	priv.Y.FillBytes(y)
+	return ecJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// stripQuery drops everything from the first "?" onward, since a DPoP
+// proof's htu claim covers the request URL without its query string.
+func stripQuery(path string) string {
+	if idx := strings.Index(path, "?"); idx != -1 {
+		return path[:idx]
+	}
+	return path
+}
+
+// buildDPoPProof signs an RFC 9449 proof JWT binding this request's method
+// and URL to our proof-of-possession key, so service-b can confirm the
+// bearer token's cnf.jkt claim was issued to whoever holds this key.
+func buildDPoPProof(priv *ecdsa.PrivateKey, method, url string) (string, error) {
+	header := map[string]interface{}{
+		"typ": "dpop+jwt",
+		"alg": "ES256",
+		"jwk": publicJWK(priv),
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("failed to generate jti: %w", err)
+	}
+	claims := map[string]interface{}{
+		"htm": method,
+		"htu": url,
+		"iat": time.Now().Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal DPoP header: %w", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal DPoP claims: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	hashed := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, hashed[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign DPoP proof: %w", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// injectDPoPProof attaches a freshly-signed DPoP proof to the outbound
+// request. This runs on every request regardless of whether the bearer
+// token came from cache, since a proof is only valid for a single
+// method+URL+instant and can't itself be cached.
+func (ctx *httpContext) injectDPoPProof(method, authority, path string) error {
+	priv, err := loadDPoPKey()
+	if err != nil {
+		return err
+	}
+	htu := fmt.Sprintf("http://%s%s", authority, stripQuery(path))
+	proof, err := buildDPoPProof(priv, method, htu)
+	if err != nil {
+		return err
+	}
+	return proxywasm.ReplaceHttpRequestHeader("DPoP", proof)
+}
+
 // OnHttpRequestHeaders is called when request headers are received
 // This is where we intercept outbound requests and fetch JWT tokens
 func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
@@ -67,80 +420,465 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		return types.ActionContinue
 	}
 
-	proxywasm.LogInfof("[Client WASM] Intercepted request to %s, fetching JWT token", authority)
+	path, _ := proxywasm.GetHttpRequestHeader(":path")
+	method, _ := proxywasm.GetHttpRequestHeader(":method")
+	asset := extractAssetFromPath(path)
+	ctx.cacheKey = tokenCacheKey(clientServiceID, authority, asset)
+	ctx.traceparent, _ = proxywasm.GetHttpRequestHeader("traceparent")
+
+	if err := ctx.injectDPoPProof(method, authority, path); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to attach DPoP proof: %v", err)
+	}
+
+	now := time.Now().Unix()
+	if entry, ok := ctx.readCache(); ok {
+		if entry.Negative && now < entry.NegativeUntil {
+			jwtCacheHitMetric.Increment(1)
+			proxywasm.LogInfof("[Client WASM] negative cache hit for %s, skipping vending callout", ctx.cacheKey)
+			return types.ActionContinue
+		}
+		if !entry.Negative && now < entry.ExpiresAt {
+			jwtCacheHitMetric.Increment(1)
+			ctx.injectToken(entry.Token)
+			if entry.ExpiresAt-now <= proactiveRefreshWindowSeconds && mathrand.Intn(3) == 0 {
+				proxywasm.LogInfof("[Client WASM] token for %s nearing expiry, triggering jittered background refresh", ctx.cacheKey)
+				ctx.dispatchTokenFetch(true)
+			}
+			return types.ActionContinue
+		}
+	}
 
-	// Prepare request to JWT vending service
-	// Request body: {"service_id": "service-a"}
-	requestBody := `{"service_id":"service-a"}`
+	jwtCacheMissMetric.Increment(1)
+	proxywasm.LogInfof("[Client WASM] cache miss for %s, fetching JWT token", ctx.cacheKey)
+	return ctx.fetchOrPark()
+}
+
+// readCache returns the cached entry for ctx.cacheKey, if any.
+func (ctx *httpContext) readCache() (tokenCacheEntry, bool) {
+	raw, _, err := proxywasm.GetSharedData(ctx.cacheKey)
+	if err != nil || len(raw) == 0 {
+		return tokenCacheEntry{}, false
+	}
+	var entry tokenCacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return tokenCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// injectToken sets the Authorization header from an already-cached token.
+func (ctx *httpContext) injectToken(token string) {
+	authHeader := fmt.Sprintf("Bearer %s", token)
+	if err := proxywasm.ReplaceHttpRequestHeader("Authorization", authHeader); err != nil {
+		proxywasm.LogErrorf("[Client WASM] Failed to set Authorization header: %v", err)
+	}
+}
+
+// fetchOrPark either becomes the single in-flight fetcher for ctx.cacheKey,
+// or parks this request behind whichever context is already fetching it,
+// coalescing concurrent misses into one callout to the vending service.
+func (ctx *httpContext) fetchOrPark() types.Action {
+	key := pendingKey(ctx.cacheKey)
+	raw, cas, err := proxywasm.GetSharedData(key)
+	now := time.Now().Unix()
+
+	if err == nil && len(raw) > 0 {
+		var pending pendingEntry
+		if json.Unmarshal(raw, &pending) == nil && now-pending.StartedAt < pendingTTLSeconds {
+			pending.Waiters = append(pending.Waiters, ctx.contextID)
+			updated, _ := json.Marshal(pending)
+			if err := proxywasm.SetSharedData(key, updated, cas); err == nil {
+				proxywasm.LogInfof("[Client WASM] parking request behind in-flight fetch for %s", ctx.cacheKey)
+				return types.ActionPause
+			}
+			// Lost the CAS race; fall through and dispatch our own fetch
+			// rather than risk parking forever.
+		}
+	}
+
+	pending := pendingEntry{StartedAt: now}
+	marshaled, _ := json.Marshal(pending)
+	if err := proxywasm.SetSharedData(key, marshaled, cas); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to claim fetch for %s: %v", ctx.cacheKey, err)
+	}
+
+	ctx.dispatchTokenFetch(false)
+	return types.ActionPause
+}
+
+// dispatchTokenFetch calls out to the vending service for a fresh token.
+// background is true for proactive refreshes triggered from a cache hit,
+// where the dispatching request has already returned ActionContinue and
+// must not be resumed again.
+//
+// Minting is gated on a hashcash proof-of-work stamp, so this first fetches
+// a challenge; handleHashcashChallengeResponse solves it and dispatches the
+// actual token request once that's done.
+func (ctx *httpContext) dispatchTokenFetch(background bool) {
+	ctx.pendingFetchBackground = background
+
+	requestBody, err := json.Marshal(struct {
+		ServiceID string `json:"service_id"`
+	}{ServiceID: clientServiceID})
+	if err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to marshal hashcash challenge request: %v", err)
+		ctx.failTokenFetch()
+		return
+	}
 
-	// Make HTTP callout to JWT vending service
 	headers := [][2]string{
 		{":method", "POST"},
-		{":path", jwtVendingServicePath},
-		{":authority", "jwt-vending-service:8081"},
+		{":path", hashcashChallengePath},
+		{":authority", jwksAuthority},
 		{"content-type", "application/json"},
 	}
+	if ctx.traceparent != "" {
+		headers = append(headers, [2]string{"traceparent", ctx.traceparent})
+	}
 
-	// DispatchHttpCall in v0.24.0 takes a callback function
-	_, err = proxywasm.DispatchHttpCall(
-		jwtVendingServiceCluster,
-		headers,
-		[]byte(requestBody),
-		nil,
-		5000, // 5 second timeout
-		ctx.handleJWTResponse,
-	)
+	if _, err := proxywasm.DispatchHttpCall(jwtVendingServiceCluster, headers, requestBody, nil, 5000, ctx.handleHashcashChallengeResponse); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to dispatch hashcash challenge request: %v", err)
+		ctx.failTokenFetch()
+	}
+}
 
+// failTokenFetch records a negative cache entry for a foreground fetch, the
+// same way a failed token callout always has. A background refresh has no
+// originating request waiting on it, so there's nothing to resolve.
+func (ctx *httpContext) failTokenFetch() {
+	if !ctx.pendingFetchBackground {
+		ctx.resolveFetch(tokenCacheEntry{Negative: true, NegativeUntil: time.Now().Unix() + negativeCacheTTLSeconds})
+	}
+}
+
+// hashcashChallenge mirrors the vending service's POST /api/new-hashcash
+// response: a proof-of-work puzzle tied to this sidecar's service ID.
+type hashcashChallenge struct {
+	Resource string `json:"resource"`
+	Bits     int    `json:"bits"`
+	Expires  int64  `json:"expires"`
+	Nonce    string `json:"nonce"`
+	MAC      string `json:"mac"`
+}
+
+// handleHashcashChallengeResponse solves the challenge and dispatches the
+// actual token request with the solved stamp attached.
+func (ctx *httpContext) handleHashcashChallengeResponse(numHeaders, bodySize, numTrailers int) {
+	responseBody, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
 	if err != nil {
-		proxywasm.LogErrorf("[Client WASM] Failed to dispatch HTTP call to JWT vending service: %v", err)
-		// Continue without JWT rather than blocking the request
-		return types.ActionContinue
+		proxywasm.LogErrorf("[Client WASM] failed to read hashcash challenge response: %v", err)
+		ctx.failTokenFetch()
+		return
 	}
 
-	proxywasm.LogInfof("[Client WASM] Dispatched HTTP call to JWT vending service")
+	var challenge hashcashChallenge
+	if err := json.Unmarshal(responseBody, &challenge); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to parse hashcash challenge response: %v", err)
+		ctx.failTokenFetch()
+		return
+	}
 
-	// Pause the request until we get the JWT token
-	return types.ActionPause
+	ctx.dispatchTokenFetchWithStamp(solveHashcash(challenge))
+}
+
+// solveHashcash brute-forces a counter until the SHA-256 digest of the full
+// stamp string has at least challenge.Bits leading zero bits, then returns
+// the solved stamp ready to go in an X-Hashcash header.
+func solveHashcash(challenge hashcashChallenge) string {
+	prefix := fmt.Sprintf("1:%d:%d:%s:%s:%s:", challenge.Bits, challenge.Expires, challenge.Resource, challenge.Nonce, challenge.MAC)
+	for counter := uint64(0); ; counter++ {
+		stamp := prefix + strconv.FormatUint(counter, 10)
+		sum := sha256.Sum256([]byte(stamp))
+		if leadingZeroBits(sum[:]) >= challenge.Bits {
+			return stamp
+		}
+	}
+}
+
+// leadingZeroBits counts digest's leading zero bits, most significant byte
+// first.
+func leadingZeroBits(digest []byte) int {
+	count := 0
+	for _, b := range digest {
+		if b == 0 {
+			count += 8
+			continue
+		}
+		for mask := byte(0x80); mask > 0; mask >>= 1 {
+			if b&mask != 0 {
+				return count
+			}
+			count++
+		}
+	}
+	return count
+}
+
+// dispatchTokenFetchWithStamp is the second half of dispatchTokenFetch: it
+// requests the actual token, with a solved hashcash stamp attached so the
+// vending service will mint it.
+func (ctx *httpContext) dispatchTokenFetchWithStamp(stamp string) {
+	tokenReq := struct {
+		ServiceID string `json:"service_id"`
+		JWK       *ecJWK `json:"jwk,omitempty"`
+	}{ServiceID: clientServiceID}
+
+	if priv, err := loadDPoPKey(); err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to load DPoP key, requesting an unbound token: %v", err)
+	} else {
+		jwk := publicJWK(priv)
+		tokenReq.JWK = &jwk
+	}
+
+	requestBody, err := json.Marshal(tokenReq)
+	if err != nil {
+		proxywasm.LogErrorf("[Client WASM] failed to marshal token request: %v", err)
+		ctx.failTokenFetch()
+		return
+	}
+
+	headers := [][2]string{
+		{":method", "POST"},
+		{":path", jwtVendingServicePath},
+		{":authority", jwksAuthority},
+		{"content-type", "application/json"},
+		{"X-Hashcash", stamp},
+	}
+	if ctx.traceparent != "" {
+		headers = append(headers, [2]string{"traceparent", ctx.traceparent})
+	}
+
+	callback := ctx.handleJWTResponse
+	if ctx.pendingFetchBackground {
+		callback = ctx.handleBackgroundRefreshResponse
+	}
+
+	tokenFetchDispatchedMetric.Increment(1)
+	if _, err := proxywasm.DispatchHttpCall(jwtVendingServiceCluster, headers, requestBody, nil, 5000, callback); err != nil {
+		proxywasm.LogErrorf("[Client WASM] Failed to dispatch HTTP call to JWT vending service: %v", err)
+		ctx.failTokenFetch()
+	}
+}
+
+// handleBackgroundRefreshResponse updates the cache from a proactive
+// refresh callout. The originating request already continued, so there is
+// nothing to resume here - only waiters (if any piled up in the meantime)
+// need releasing.
+func (ctx *httpContext) handleBackgroundRefreshResponse(numHeaders, bodySize, numTrailers int) {
+	entry := ctx.parseTokenCallout(bodySize)
+	ctx.resolveFetch(entry)
 }
 
 // handleJWTResponse is called when the HTTP callout response is received
 func (ctx *httpContext) handleJWTResponse(numHeaders, bodySize, numTrailers int) {
 	proxywasm.LogInfof("[Client WASM] Received JWT response (headers: %d, body: %d)", numHeaders, bodySize)
 
-	// Get response body
+	entry := ctx.parseTokenCallout(bodySize)
+	if !entry.Negative {
+		ctx.injectToken(entry.Token)
+	}
+	ctx.resolveFetch(entry)
+	proxywasm.ResumeHttpRequest()
+}
+
+// parseTokenCallout reads and validates the vending service's response body,
+// returning either a populated token entry or a negative-cache entry.
+func (ctx *httpContext) parseTokenCallout(bodySize int) tokenCacheEntry {
+	negative := tokenCacheEntry{Negative: true, NegativeUntil: time.Now().Unix() + negativeCacheTTLSeconds}
+
 	responseBody, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
 	if err != nil {
 		proxywasm.LogErrorf("[Client WASM] Failed to get response body: %v", err)
-		proxywasm.ResumeHttpRequest()
-		return
+		return negative
 	}
 
-	// Parse token response
 	var tokenResp TokenResponse
 	if err := json.Unmarshal(responseBody, &tokenResp); err != nil {
 		proxywasm.LogErrorf("[Client WASM] Failed to parse token response: %v", err)
-		proxywasm.ResumeHttpRequest()
-		return
+		return negative
 	}
 
 	if tokenResp.Token == "" {
 		proxywasm.LogErrorf("[Client WASM] Empty token received from JWT vending service")
-		proxywasm.ResumeHttpRequest()
-		return
+		return negative
 	}
 
-	proxywasm.LogInfof("[Client WASM] Successfully obtained JWT token (length: %d)", len(tokenResp.Token))
+	// Validate the token we just received before trusting it onto the wire:
+	// this catches a compromised or misconfigured vending service handing
+	// out tokens that wouldn't actually pass service-b's own verification.
+	if err := ctx.verifyToken(tokenResp.Token); err != nil {
+		jwtVerifyFailureMetric.Increment(1)
+		proxywasm.LogErrorf("[Client WASM] Refusing to cache JWT that failed verification: %v", err)
+		return negative
+	}
 
-	// Inject JWT token into the Authorization header
-	authHeader := fmt.Sprintf("Bearer %s", tokenResp.Token)
-	if err := proxywasm.ReplaceHttpRequestHeader("Authorization", authHeader); err != nil {
-		proxywasm.LogErrorf("[Client WASM] Failed to set Authorization header: %v", err)
+	proxywasm.LogInfof("[Client WASM] Successfully obtained and verified JWT token (length: %d)", len(tokenResp.Token))
+	return tokenCacheEntry{
+		Token:     tokenResp.Token,
+		ExpiresAt: time.Now().Unix() + tokenResp.ExpiresIn,
+	}
+}
+
+// resolveFetch writes entry to the shared cache, clears the pending marker
+// for ctx.cacheKey, and resumes every request that parked behind this fetch.
+func (ctx *httpContext) resolveFetch(entry tokenCacheEntry) {
+	marshaled, _ := json.Marshal(entry)
+	if _, cas, err := proxywasm.GetSharedData(ctx.cacheKey); err == nil {
+		proxywasm.SetSharedData(ctx.cacheKey, marshaled, cas)
 	} else {
-		proxywasm.LogInfof("[Client WASM] Injected JWT token into Authorization header")
+		proxywasm.SetSharedData(ctx.cacheKey, marshaled, 0)
 	}
 
-	// Resume the request
-	proxywasm.ResumeHttpRequest()
+	key := pendingKey(ctx.cacheKey)
+	raw, pendingCas, err := proxywasm.GetSharedData(key)
+	if err != nil || len(raw) == 0 {
+		return
+	}
+	var pending pendingEntry
+	if json.Unmarshal(raw, &pending) != nil {
+		return
+	}
+	proxywasm.SetSharedData(key, nil, pendingCas)
+
+	for _, waiterID := range pending.Waiters {
+		if err := proxywasm.SetEffectiveContext(waiterID); err != nil {
+			proxywasm.LogErrorf("[Client WASM] failed to switch to waiter context %d: %v", waiterID, err)
+			continue
+		}
+		if !entry.Negative {
+			authHeader := fmt.Sprintf("Bearer %s", entry.Token)
+			proxywasm.ReplaceHttpRequestHeader("Authorization", authHeader)
+		}
+		proxywasm.ResumeHttpRequest()
+	}
+	proxywasm.SetEffectiveContext(ctx.contextID)
+}
+
+// audClaim decodes an RFC 7519 "aud" claim, which may be serialized as
+// either a single string or an array of strings - the vending service's
+// golang-jwt library emits the latter even for a single audience.
+type audClaim []string
+
+func (a *audClaim) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audClaim{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = multi
+	return nil
+}
+
+func (a audClaim) contains(audience string) bool {
+	for _, v := range a {
+		if v == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyToken checks the JWT's RS256 signature against the cached JWKS and
+// validates the alg/kid/iss/aud/exp claims.
+func (ctx *httpContext) verifyToken(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid header encoding: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	if header.Kid == "" {
+		return fmt.Errorf("missing kid")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid claims encoding: %w", err)
+	}
+	var claims struct {
+		Iss string   `json:"iss"`
+		Aud audClaim `json:"aud"`
+		Exp int64    `json:"exp"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return fmt.Errorf("invalid claims: %w", err)
+	}
+	if claims.Iss != expectedIssuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Iss)
+	}
+	if !claims.Aud.contains(expectedAudience) {
+		return fmt.Errorf("unexpected audience %v", claims.Aud)
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return fmt.Errorf("token expired")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	pub, err := ctx.lookupKey(header.Kid)
+	if err != nil {
+		return err
+	}
+
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	return nil
+}
+
+// lookupKey resolves a kid against the cached JWKS.
+func (ctx *httpContext) lookupKey(kid string) (*rsa.PublicKey, error) {
+	raw, _, err := proxywasm.GetSharedData(jwksSharedDataKey)
+	if err != nil || len(raw) == 0 {
+		return nil, fmt.Errorf("JWKS cache not populated yet")
+	}
+
+	var set jwkSet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("corrupt cached JWKS: %w", err)
+	}
+
+	for _, k := range set.Keys {
+		if k.Kid != kid || k.Kty != "RSA" {
+			continue
+		}
+		nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n in JWKS: %w", err)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e in JWKS: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: int(new(big.Int).SetBytes(eBytes).Int64()),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("kid %q not found in cached JWKS", kid)
 }
 
 // OnHttpResponseHeaders is called when response headers are received
@@ -151,4 +889,4 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 		proxywasm.LogInfof("[Client WASM] Response status: %s", status)
 	}
 	return types.ActionContinue
-}
\ No newline at end of file
+}